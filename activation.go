@@ -0,0 +1,73 @@
+package main
+
+/*
+ * activation.go
+ * systemd socket activation and inetd FD inheritance
+ * by J. Stuart McMurray
+ * created 20140523
+ * last modified 20140523
+ */
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+/* listenFdsStart is the first inherited file descriptor systemd passes to
+a socket-activated process; see sd_listen_fds(3). */
+const listenFdsStart = 3
+
+/* systemdListeners returns the TCPListeners systemd passed to this process
+via socket activation (the LISTEN_FDS/LISTEN_PID environment variables,
+with FDs starting at listenFdsStart), or nil, nil if this process wasn't
+socket-activated. */
+func systemdListeners() ([]*net.TCPListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	ls := make([]*net.TCPListener, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%v", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("wrapping inherited fd %v: %w",
+				fd, err)
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return nil, fmt.Errorf("inherited fd %v is not a "+
+				"TCP listener", fd)
+		}
+		ls = append(ls, tl)
+	}
+	return ls, nil
+}
+
+/* inetdConn wraps os.Stdin as an already-accepted TCP connection, for
+classic inetd-style invocation where a listener outside this process
+accepts the connection and execs us with it on stdin. */
+func inetdConn() (*net.TCPConn, error) {
+	f := os.NewFile(uintptr(os.Stdin.Fd()), "stdin")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("wrapping stdin: %w", err)
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("stdin is not a TCP connection")
+	}
+	return tc, nil
+}
@@ -14,6 +14,8 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +28,51 @@ import (
 
 /* TODO: Have one conn ending close the other conn */
 
+/* session tracks one live proxied connection (a client conn and its
+target conn) well enough that a graceful restart (see restart.go) can
+recreate it, unmodified, in a replacement process. */
+type session struct {
+	id              string /* Same ID passed to srv.sink.Open */
+	dir             string /* logdir/<target IP>, or "" if logging's disabled */
+	rad, lad        *net.TCPAddr
+	tproxy          bool
+	r, t            *net.TCPConn
+	wg              sync.WaitGroup /* Done twice when both proxyBytes return */
+	rRead, rWritten atomic.Int64   /* Bytes read from / written to r */
+	tRead, tWritten atomic.Int64   /* Bytes read from / written to t */
+}
+
+/* server bundles the listeners and live sessions a graceful restart needs
+to hand off, along with the configuration needed to keep handling
+connections the same way afterwards. */
+type server struct {
+	buflen int
+	banner string
+	logdir *string
+	sink   SessionSink /* Where session packets are logged, or nil if -nolog */
+	tproxy bool
+
+	l4, l6 *net.TCPListener
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+/* registerSession adds s to srv's live session table. */
+func (srv *server) registerSession(s *session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.sessions[s.id] = s
+}
+
+/* unregisterSession removes the session with the given id from srv's live
+session table. */
+func (srv *server) unregisterSession(id string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.sessions, id)
+}
+
 func main() {
 	/* Parse options */
 	listenAddr := flag.String("addr", ":23", "[Address and] port on "+
@@ -41,8 +88,67 @@ func main() {
 			"banner.  A newline will be appended to the banner "+
 			"after sending.")
 	buflen := flag.Int("buflen", 1024, "Read buffer size.")
+	replayFile := flag.String("replay", "", "Replay a previously-captured "+
+		".owm session log against -target instead of listening for "+
+		"connections.")
+	target := flag.String("target", "", "Address to which to connect "+
+		"when -replay is given.")
+	speed := flag.Float64("speed", 1, "With -replay, multiplier applied "+
+		"to the delays between packets.  Larger is faster.")
+	nowait := flag.Bool("nowait", false, "With -replay, don't wait "+
+		"between packets; send them as fast as possible.")
+	verify := flag.Bool("verify", false, "With -replay, reconnect to "+
+		"-target and verify the mirrored bytes match the recorded "+
+		"session rather than simply replaying it.")
+	logFmtName := flag.String("logfmt", "owm", "Session log format: "+
+		"owm, pcap, pcapng, or both (owm and pcap).")
+	tproxy := flag.Bool("tproxy", false, "Listen and dial with "+
+		"IP_TRANSPARENT (Linux only), so onewaymirror may be "+
+		"inserted via an iptables TPROXY rule and mirror any "+
+		"intercepted flow while preserving the original client "+
+		"address towards the true destination.")
+	inetd := flag.Bool("inetd", false, "Run in inetd mode: treat stdin "+
+		"as an already-accepted connection instead of listening "+
+		"for new ones, and exit once it's handled.")
+	var sinkSpecs sinkFlag
+	flag.Var(&sinkSpecs, "sink", "Session-storage sink, as "+
+		"name[,opt=val,...].  May be given more than once to tee "+
+		"sessions to every named sink.  Supported names: file "+
+		"(the default; opts: logfmt, dir), rotate (file with "+
+		"eviction; opts: logfmt, dir, maxsize, maxsessions, "+
+		"maxage), jsonl (opts: path), http (streams completed "+
+		"sessions via HTTP POST, e.g. to S3; opts: url).")
 	flag.Parse()
 
+	logFmt, err := parseLogFormat(*logFmtName)
+	if err != nil {
+		log.Fatalf("-logfmt: %v", err)
+	}
+
+	/* Replay (or verify) a captured session instead of proxying */
+	if "" != *replayFile {
+		if "" == *target {
+			log.Fatalf("-target is required with -replay")
+		}
+		if *verify {
+			if err := verifySession(*replayFile, *target,
+				*buflen); err != nil {
+				log.Fatalf("Verification of %v against %v "+
+					"failed: %v", *replayFile, *target,
+					err)
+			}
+			log.Printf("%v matches the session mirrored by %v",
+				*replayFile, *target)
+		} else {
+			if err := replaySession(*replayFile, *target, *speed,
+				*nowait); err != nil {
+				log.Fatalf("Unable to replay %v against %v: "+
+					"%v", *replayFile, *target, err)
+			}
+		}
+		return
+	}
+
 	/* Make sure logdir exists */
 	/* TODO: unhardcode the perms */
 	if !*disableLogging {
@@ -54,6 +160,45 @@ func main() {
 		logDir = nil
 	}
 
+	/* Build the session-storage sink(s) -sink asked for, or, absent
+	any, the same on-disk .owm/pcap/pcapng sink onewaymirror's always
+	used.  -nolog disables session storage outright, regardless of
+	-sink. */
+	var sink SessionSink
+	if logDir != nil {
+		var err error
+		sink, err = buildSink([]string(sinkSpecs), logDir, logFmt)
+		if err != nil {
+			log.Fatalf("-sink: %v", err)
+		}
+	}
+
+	/* Append a newline to the banner if appropriate */
+	if len(*banner) > 0 {
+		*banner += "\n"
+	}
+
+	srv := &server{
+		buflen:   *buflen,
+		banner:   *banner,
+		logdir:   logDir,
+		sink:     sink,
+		tproxy:   *tproxy,
+		sessions: make(map[string]*session),
+	}
+
+	/* Classic inetd-style invocation: stdin is itself the accepted
+	connection, and there's nothing to listen for. */
+	if *inetd {
+		c, err := inetdConn()
+		if err != nil {
+			log.Fatalf("Unable to use stdin as an inetd "+
+				"connection: %v", err)
+		}
+		handleConn(srv, c)
+		return
+	}
+
 	/* Channels on which to receive connections */
 	var ch4, ch6 chan *net.TCPConn
 
@@ -62,36 +207,64 @@ func main() {
 	allDead := make(chan int)
 	n := 0
 
-	/* Append a newline to the banner if appropriate */
-	if len(*banner) > 0 {
-		*banner += "\n"
-	}
-
-	/* Try to listen */
 	if *disable4 && *disable6 {
 		log.Fatalf("-no4 and -no6 may not both be specified.")
 	}
-	var l4, l6 *net.TCPListener
-	if !*disable4 {
-		l4 = listener("tcp4", *listenAddr)
-		if l4 != nil {
-			ch4 = make(chan *net.TCPConn)
-			n++
-			go waitConn(l4, ch4, dead)
+
+	/* Get our listeners from, in order of preference, a graceful
+	restart's manifest, systemd socket activation, or, failing both,
+	by listening ourselves. */
+	if fd, ok := restarting(); ok {
+		if err := resumeFromRestart(fd, srv); err != nil {
+			log.Fatalf("Unable to resume from a graceful "+
+				"restart: %v", err)
 		}
-	}
-	if !*disable6 {
-		l6 = listener("tcp6", *listenAddr)
-		if l6 != nil {
-			ch6 = make(chan *net.TCPConn)
-			n++
-			go waitConn(l6, ch6, dead)
+	} else {
+		sls, err := systemdListeners()
+		if err != nil {
+			log.Fatalf("Unable to use systemd-activated "+
+				"sockets: %v", err)
+		}
+		if sls != nil {
+			for _, l := range sls {
+				ta, ok := l.Addr().(*net.TCPAddr)
+				if !ok {
+					log.Fatalf("Inherited listener %v "+
+						"isn't TCP", l.Addr())
+				}
+				if nil != ta.IP.To4() {
+					srv.l4 = l
+				} else {
+					srv.l6 = l
+				}
+			}
+		} else {
+			if !*disable4 {
+				srv.l4 = listener("tcp4", *listenAddr, *tproxy)
+			}
+			if !*disable6 {
+				srv.l6 = listener("tcp6", *listenAddr, *tproxy)
+			}
 		}
 	}
-	if nil == l4 && nil == l6 {
+	if srv.l4 != nil {
+		ch4 = make(chan *net.TCPConn)
+		n++
+		go waitConn(srv.l4, ch4, dead)
+	}
+	if srv.l6 != nil {
+		ch6 = make(chan *net.TCPConn)
+		n++
+		go waitConn(srv.l6, ch6, dead)
+	}
+	if nil == srv.l4 && nil == srv.l6 {
 		log.Fatalf("Unaable to create any listeners")
 	}
 
+	/* SIGUSR2 triggers a graceful restart, handing srv's listeners and
+	live sessions to a freshly-exec'd replacement. */
+	installRestartHandler(srv)
+
 	/* Start listeners */
 	go waitDead(n, dead, allDead)
 
@@ -99,9 +272,9 @@ func main() {
 	for {
 		select {
 		case c := <-ch4:
-			go handleConn(c, *buflen, *banner, logDir)
+			go handleConn(srv, c)
 		case c := <-ch6:
-			go handleConn(c, *buflen, *banner, logDir)
+			go handleConn(srv, c)
 		case <-allDead:
 			log.Fatalf("All listeners have terminated")
 		}
@@ -112,19 +285,23 @@ func main() {
 }
 
 /* Goroutine to handle incoming connection */
-/* handleConn handles incoming connections using a buffer of buflen bytes and
-sending banner to each incoming connection if banner is not the empty string.
-Sessions will be logged in logdir. */
-func handleConn(r *net.TCPConn, buflen int, banner string, logdir *string) {
+/* handleConn handles an incoming connection using srv's configuration,
+sending srv.banner if it's not the empty string.  The session, including
+both r and the connection made back to its target, is registered with srv
+so a graceful restart (see restart.go) can hand it off intact.  If
+srv.tproxy is true, r is assumed to have been accepted on a
+tproxyListener, and the connection back to the original destination is
+made with tproxyDial instead of a plain DialTCP. */
+func handleConn(srv *server, r *net.TCPConn) {
 	defer r.Close()
 	constr := fmt.Sprintf("%v -> %v", r.RemoteAddr(), r.LocalAddr())
 	log.Printf("Connection got: %v", constr)
 
 	/* Send banner to each connecting connection */
-	if l := len(banner); l > 0 {
+	if l := len(srv.banner); l > 0 {
 		s := 0
 		for s < l {
-			n, err := r.Write([]byte(banner))
+			n, err := r.Write([]byte(srv.banner))
 			if err != nil {
 				log.Printf("Unable to send banner to %v: %v",
 					r.RemoteAddr(), err)
@@ -134,9 +311,6 @@ func handleConn(r *net.TCPConn, buflen int, banner string, logdir *string) {
 		}
 	}
 
-	/* Target */
-	ta := &net.TCPAddr{}
-
 	/* Build the target address:port */
 	rad, ok := r.RemoteAddr().(*net.TCPAddr)
 	if !ok {
@@ -144,17 +318,32 @@ func handleConn(r *net.TCPConn, buflen int, banner string, logdir *string) {
 			"report.", r.RemoteAddr())
 		return
 	}
-	ta.IP = rad.IP
 	lad, ok := r.LocalAddr().(*net.TCPAddr)
 	if !ok {
 		log.Printf("%v is not a TCP address.  Please file a bug "+
 			"report.", r.LocalAddr())
 		return
 	}
-	ta.Port = lad.Port
 
-	/* Try to connect right back */
-	t, err := net.DialTCP("tcp", nil, ta)
+	/* Work out the target, and connect to it */
+	var ta *net.TCPAddr
+	var t *net.TCPConn
+	var err error
+	if srv.tproxy {
+		/* Under TPROXY, lad is the listener's own address, not the
+		original destination; recover the real one and dial out
+		spoofed as the original client. */
+		ta, err = originalDst(r)
+		if err != nil {
+			log.Printf("Unable to recover the original "+
+				"destination of %v: %v", constr, err)
+			return
+		}
+		t, err = tproxyDial(rad, ta)
+	} else {
+		ta = &net.TCPAddr{IP: rad.IP, Port: lad.Port}
+		t, err = net.DialTCP("tcp", nil, ta)
+	}
 	if err != nil {
 		e := fmt.Sprintf("Unable to connect back to %v", ta)
 		log.Printf("%v: %v", e, err)
@@ -168,33 +357,72 @@ func handleConn(r *net.TCPConn, buflen int, banner string, logdir *string) {
 	tgtstr := fmt.Sprintf("%v -> %v", t.LocalAddr(), t.RemoteAddr())
 	log.Printf("Connection made: %v", tgtstr)
 
-	/* Per-session Logging */
-	var in chan packet
-	var out chan packet
-	if logdir != nil {
-		in = make(chan packet)
-		out = make(chan packet)
-		defer close(in)
-		defer close(out)
-		go logSession(in, out, path.Join(*logdir, ta.IP.String()),
-			time.Now().Format(time.RFC3339Nano))
+	sess := &session{
+		id:     time.Now().Format(time.RFC3339Nano),
+		rad:    rad,
+		lad:    lad,
+		tproxy: srv.tproxy,
+		r:      r,
+		t:      t,
+	}
+
+	/* Per-session logging, via whichever SessionSink(s) -sink asked
+	for. */
+	var in, out chan packet
+	if srv.logdir != nil {
+		sess.dir = path.Join(*srv.logdir, ta.IP.String())
 	}
+	if srv.sink != nil {
+		if logger, err := srv.sink.Open(SessionMeta{
+			ID:  sess.id,
+			Dir: sess.dir,
+			Rad: rad,
+			Lad: lad,
+		}); err != nil {
+			log.Printf("Unable to open a session sink for %v: %v",
+				constr, err)
+		} else if logger != nil {
+			in = make(chan packet)
+			out = make(chan packet)
+			defer close(in)
+			defer close(out)
+			go runSink(in, out, logger)
+		}
+	}
+
+	srv.registerSession(sess)
+	defer srv.unregisterSession(sess.id)
 
 	/* Proxy bytes */
+	sess.wg.Add(2)
 	done := make(chan *net.TCPConn)
-	go proxyBytes(r, t, done, buflen, constr, in)
-	go proxyBytes(t, r, done, buflen, tgtstr, out)
+	go proxyBytes(r, t, done, srv.buflen, constr, in, &sess.wg,
+		&sess.rRead, &sess.rWritten)
+	go proxyBytes(t, r, done, srv.buflen, tgtstr, out, &sess.wg,
+		&sess.tRead, &sess.tWritten)
 
 	/* Close both sides when one closes */
 	<-done
 }
 
-/* Make a TCPListener for the specified tcp family: tcp4 or tcp6 */
-func listener(t, addr string) *net.TCPListener {
+/* Make a TCPListener for the specified tcp family: tcp4 or tcp6.  If tproxy
+is true, the listener is made with tproxyListener instead of a plain
+ListenTCP, so it may receive iptables TPROXY'd connections. */
+func listener(t, addr string, tproxy bool) *net.TCPListener {
 	if t != "tcp4" && t != "tcp6" {
 		panic("listener() takes either \"tcp4\" or \"tcp6\" as its " +
 			"first argument.")
 	}
+	if tproxy {
+		l, err := tproxyListener(t, addr)
+		if err != nil {
+			log.Fatalf("Unable to listen on %v (tproxy): %v",
+				addr, err)
+			return nil
+		}
+		log.Printf("Listening on %v (tproxy)", l.Addr())
+		return l
+	}
 	tcpAddr, err := net.ResolveTCPAddr(t, addr)
 	if err != nil {
 		log.Fatalf("Unable to resolve %v address %v: %v", t, addr, err)
@@ -233,10 +461,16 @@ func waitDead(n int, in, out chan int) {
 }
 
 /* proxyBytes proxies bytes between src and dst using a buffer of buflen bytes.
-it sends an int to done when it's done.  cstr describes the connection as
-a string */
+it sends an int to done when it's done, and calls wg.Done() so a graceful
+restart (see restart.go) can tell when it's safe to hand src and dst off to
+a replacement process.  rcount and wcount are kept up to date with the
+total bytes read from src and written to dst, respectively, so a restart
+can resume the counters in its own manifest.  cstr describes the
+connection as a string */
 func proxyBytes(src, dst *net.TCPConn, done chan *net.TCPConn, buflen int,
-	cstr string, logc chan packet) {
+	cstr string, logc chan packet, wg *sync.WaitGroup, rcount,
+	wcount *atomic.Int64) {
+	defer wg.Done()
 	buf := make([]byte, buflen)
 	read := 0
 	written := 0
@@ -249,6 +483,7 @@ func proxyBytes(src, dst *net.TCPConn, done chan *net.TCPConn, buflen int,
 		/* Read a bit */
 		n, err := src.Read(buf)
 		read += n
+		rcount.Add(int64(n))
 		urws()
 		if err != nil {
 			/* End of file */
@@ -285,6 +520,7 @@ func proxyBytes(src, dst *net.TCPConn, done chan *net.TCPConn, buflen int,
 		for start < end {
 			n, err := dst.Write(buf[start:end])
 			written += n
+			wcount.Add(int64(n))
 			urws()
 			if e, ok := err.(net.Error); ok {
 				if !e.Temporary() {
@@ -300,97 +536,7 @@ func proxyBytes(src, dst *net.TCPConn, done chan *net.TCPConn, buflen int,
 	}
 }
 
-/* logSession waits for packets on p and writes them to two files starting with
-the prefix prefix, which should be a path.  The files will be a .log containig
-a textual representation of the session, and a .owm, which will be
-replayable */
-func logSession(in, out chan packet, dir, prefix string) {
-	/* Open files */
-	// tlog := openLogFile(prefix + ".log")
-	/* TODO: text log */
-	olog := openLogFile(dir, prefix+".owm")
-	defer olog.Close()
-	/* If the channels are closed */
-	var iclosed, oclosed bool
-	/* Wait for input */
-	for {
-		/* Die if both channels are closed */
-		if iclosed && oclosed {
-			break
-		}
-		/* Get some bytes to log */
-		select {
-		case p, ok := <-in:
-			if !ok {
-				iclosed = true
-				continue
-			}
-			t := time.Now()
-			logPacket(olog, p, true, t)
-		case p, ok := <-out:
-			if !ok {
-				oclosed = true
-				continue
-			}
-			t := time.Now()
-			logPacket(olog, p, false, t)
-		}
-	}
-}
-
-/* openLogFile opens a log file or prints an error and returns nil */
-func openLogFile(dir, name string) *os.File {
-	/* TODO: Unhardcode modes */
-	/* Make sure directory exists */
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Fatalf("Unable to create directory %v: %v", dir, err)
-		return nil
-	}
-
-	f, err := os.OpenFile(path.Join(dir, name),
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
-	if err != nil {
-		log.Printf("Unable to open %v: %v", name, err)
-		return nil
-	}
-	return f
-}
-
-/* packet represents a packet */
-type packet struct {
-	data   []byte
-	length int
-}
-
-/* logPacket writes a packet p to the (.owm) logfile f, tagged with direction
-d (true: in, false: out) at time t.  If f is nil, logPacket returns
-immediately */
-func logPacket(f *os.File, p packet, d bool, t time.Time) {
-	if f == nil {
-		return
-	}
-	/* Direction as a rune */
-	var dc rune
-	if d {
-		dc = 'i'
-	} else {
-		dc = 'o'
-	}
-	/* Metadata */
-	/* timestamp\tseconds.nanoseconds\tdirection\tdatalen\tdata */
-	s := fmt.Sprintf("\n%v\t%v.%v\t%c\t%v\t", t.Format(time.StampNano),
-		t.Unix(), t.Nanosecond(), dc, p.length)
-	if n, err := f.Write([]byte(s)); err != nil {
-		log.Printf("Only wrote %v/%v bytes of metadata to %v: %v", n,
-			len(s), f.Name(), err)
-		f.Close()
-	}
-	/* Payload */
-	if n, err := f.Write(p.data[0:p.length]); err != nil {
-		log.Printf("Only wrote %v/%v bytes of payload data to %v: %v",
-			n, p.length, f.Name(), err)
-		f.Close()
-	}
-}
+/* packet, runSink and the SessionSink implementations that consume it now
+live in sink.go. */
 
 /* Can make a connection, but breaking connections don't seem to do anything.  Also, nothing gets logged, but the file gets made */
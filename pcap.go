@@ -0,0 +1,233 @@
+package main
+
+/*
+ * pcap.go
+ * Synthesize pcap/pcapng captures from mirrored sessions
+ * by J. Stuart McMurray
+ * created 20140509
+ * last modified 20140509
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+/* linkTypeRaw is the pcap/pcapng LINKTYPE_RAW value, used so synthesized
+segments can be written as bare IP packets without having to fabricate an
+Ethernet (or other) link layer. */
+const linkTypeRaw = 101
+
+/* logFormat is a bitmask of the session log formats a fileSink (see
+sink.go) should write. */
+type logFormat uint8
+
+/* Bits of a logFormat. */
+const (
+	logOWM logFormat = 1 << iota
+	logPCAP
+	logPCAPNG
+)
+
+/* parseLogFormat turns the value of -logfmt into a logFormat. */
+func parseLogFormat(s string) (logFormat, error) {
+	switch s {
+	case "owm":
+		return logOWM, nil
+	case "pcap":
+		return logPCAP, nil
+	case "pcapng":
+		return logPCAPNG, nil
+	case "both":
+		return logOWM | logPCAP, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q (want one of owm, "+
+		"pcap, pcapng, both)", s)
+}
+
+/* TCP flag bits, used when fabricating segments. */
+const (
+	tcpFIN = 1 << 0
+	tcpSYN = 1 << 1
+	tcpACK = 1 << 4
+)
+
+/* writePcapGlobalHeader writes a classic pcap file header to f, selecting
+linkTypeRaw so fabricated segments need no link-layer header. */
+func writePcapGlobalHeader(f *os.File) error {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4) /* magic, usec */
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)           /* version major */
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)           /* version minor */
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)     /* snaplen */
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeRaw)
+	_, err := f.Write(hdr[:])
+	return err
+}
+
+/* writePcapRecord appends a single packet to f, stamped with t, in classic
+pcap format. */
+func writePcapRecord(f *os.File, t time.Time, data []byte) error {
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(data)))
+	if _, err := f.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := f.Write(data)
+	return err
+}
+
+/* writePcapngSHB writes a pcapng Section Header Block to f. */
+func writePcapngSHB(f *os.File) error {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], 0x1a2b3c4d) /* byte-order magic */
+	binary.LittleEndian.PutUint16(body[4:6], 1)          /* major version */
+	binary.LittleEndian.PutUint16(body[6:8], 0)          /* minor version */
+	binary.LittleEndian.PutUint64(body[8:16], ^uint64(0)) /* section length: unknown */
+	return writePcapngBlock(f, 0x0a0d0d0a, body)
+}
+
+/* writePcapngIDB writes a pcapng Interface Description Block for a single
+session to f, describing one capture interface per the session's flow, so
+tools like Wireshark show one capture-per-flow when sessions are kept in
+separate files. */
+func writePcapngIDB(f *os.File) error {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], linkTypeRaw)
+	binary.LittleEndian.PutUint16(body[2:4], 0) /* reserved */
+	binary.LittleEndian.PutUint32(body[4:8], 65535)
+	return writePcapngBlock(f, 0x00000001, body)
+}
+
+/* writePcapngEPB appends a single packet to f, stamped with t, as a pcapng
+Enhanced Packet Block on interface 0. */
+func writePcapngEPB(f *os.File, t time.Time, data []byte) error {
+	ts := uint64(t.UnixNano() / 1000)
+	body := make([]byte, 20+pad4(len(data)))
+	binary.LittleEndian.PutUint32(body[0:4], 0) /* interface id */
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	copy(body[20:], data)
+	return writePcapngBlock(f, 0x00000006, body)
+}
+
+/* pad4 returns the number of bytes needed to pad n up to a 4-byte
+boundary, as pcapng block bodies require. */
+func pad4(n int) int {
+	if r := n % 4; r != 0 {
+		return n + (4 - r)
+	}
+	return n
+}
+
+/* writePcapngBlock writes a generic pcapng block of the given type with the
+given (already padded, if applicable) body to f, adding the block total
+length fields required at both ends of every block. */
+func writePcapngBlock(f *os.File, blockType uint32, body []byte) error {
+	total := 12 + len(body)
+	block := make([]byte, total)
+	binary.LittleEndian.PutUint32(block[0:4], blockType)
+	binary.LittleEndian.PutUint32(block[4:8], uint32(total))
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[total-4:total], uint32(total))
+	_, err := f.Write(block)
+	return err
+}
+
+/* tcpSegment fabricates a single IPv4-or-IPv6-in-raw TCP segment from src
+to dst with the given sequence/ack numbers, flags and payload, suitable for
+writing straight into a linkTypeRaw capture. */
+func tcpSegment(src, dst *net.TCPAddr, seq, ack uint32, flags uint8,
+	payload []byte) ([]byte, error) {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4 /* data offset: 5 32-bit words, no options */
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535) /* window */
+	copy(tcp[20:], payload)
+
+	sip, dip := src.IP, dst.IP
+	v4 := nil != sip.To4() && nil != dip.To4()
+	if v4 {
+		sip, dip = sip.To4(), dip.To4()
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+		ip[8] = 64 /* TTL */
+		ip[9] = 6  /* protocol: TCP */
+		copy(ip[12:16], sip)
+		copy(ip[16:20], dip)
+		binary.BigEndian.PutUint16(tcp[16:18],
+			tcpChecksum(sip, dip, true, tcp))
+		binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip))
+		return append(ip, tcp...), nil
+	}
+
+	sip, dip = sip.To16(), dip.To16()
+	if nil == sip || nil == dip {
+		return nil, fmt.Errorf("don't know how to address %v -> %v",
+			src, dst)
+	}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(tcp)))
+	ip[6] = 6 /* next header: TCP */
+	ip[7] = 64
+	copy(ip[8:24], sip)
+	copy(ip[24:40], dip)
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(sip, dip, false, tcp))
+	return append(ip, tcp...), nil
+}
+
+/* ipv4Checksum computes the IPv4 header checksum of hdr, whose checksum
+field must be zeroed. */
+func ipv4Checksum(hdr []byte) uint16 {
+	return onesComplementSum(hdr)
+}
+
+/* tcpChecksum computes the TCP checksum of tcp (whose checksum field must
+be zeroed) over the IPv4 or IPv6 pseudo-header built from src and dst. */
+func tcpChecksum(src, dst net.IP, v4 bool, tcp []byte) uint16 {
+	var pseudo []byte
+	if v4 {
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:4], src)
+		copy(pseudo[4:8], dst)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	} else {
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:16], src)
+		copy(pseudo[16:32], dst)
+		binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(tcp)))
+		pseudo[39] = 6
+	}
+	return onesComplementSum(append(pseudo, tcp...))
+}
+
+/* onesComplementSum computes the standard IP/TCP/UDP ones'-complement
+checksum of data. */
+func onesComplementSum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,212 @@
+package main
+
+/*
+ * replay.go
+ * Replay and verify .owm session logs
+ * by J. Stuart McMurray
+ * created 20140502
+ * last modified 20140502
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* record is a single logged packet as read back from a .owm file */
+type record struct {
+	at   time.Time /* When the packet was logged */
+	in   bool      /* true if this was an 'i' (client->mirror) packet */
+	data []byte
+}
+
+/* readOwmRecords reads the records in the .owm file at path, in the format
+written by logPacket: each record is a newline followed by
+"stamp\tunix.nanos\tdir\tdatalen\t" followed by datalen bytes of payload. */
+func readOwmRecords(path string) ([]record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var recs []record
+	for {
+		/* Every record starts with a newline */
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if '\n' != b {
+			return nil, fmt.Errorf("expected a newline, got %q", b)
+		}
+
+		/* Human-readable timestamp, unused */
+		if _, err := r.ReadString('\t'); err != nil {
+			return nil, fmt.Errorf("reading timestamp: %w", err)
+		}
+
+		/* unix.nanos timestamp, used for inter-packet timing */
+		uns, err := r.ReadString('\t')
+		if err != nil {
+			return nil, fmt.Errorf("reading unix timestamp: %w",
+				err)
+		}
+		at, err := parseUnixNanos(strings.TrimSuffix(uns, "\t"))
+		if err != nil {
+			return nil, fmt.Errorf("parsing unix timestamp %q: "+
+				"%w", uns, err)
+		}
+
+		/* Direction */
+		ds, err := r.ReadString('\t')
+		if err != nil {
+			return nil, fmt.Errorf("reading direction: %w", err)
+		}
+		ds = strings.TrimSuffix(ds, "\t")
+		if 1 != len(ds) || ('i' != ds[0] && 'o' != ds[0]) {
+			return nil, fmt.Errorf("invalid direction %q", ds)
+		}
+
+		/* Payload length */
+		ls, err := r.ReadString('\t')
+		if err != nil {
+			return nil, fmt.Errorf("reading length: %w", err)
+		}
+		length, err := strconv.Atoi(strings.TrimSuffix(ls, "\t"))
+		if err != nil {
+			return nil, fmt.Errorf("parsing length %q: %w", ls,
+				err)
+		}
+
+		/* Payload itself */
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("reading %v-byte payload: %w",
+				length, err)
+		}
+
+		recs = append(recs, record{at: at, in: 'i' == ds[0], data: data})
+	}
+	return recs, nil
+}
+
+/* parseUnixNanos parses a "seconds.nanoseconds" string, as written by
+logPacket, into a time.Time. */
+func parseUnixNanos(s string) (time.Time, error) {
+	parts := strings.SplitN(s, ".", 2)
+	if 2 != len(parts) {
+		return time.Time{}, fmt.Errorf("missing decimal point")
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing seconds: %w", err)
+	}
+	nsec, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing nanoseconds: %w", err)
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+/* replaySession reads the .owm file at path and re-emits its 'i' packets
+(what the original client sent) to target, preserving the original
+inter-arrival timing scaled by speed.  If nowait is true, packets are sent
+as fast as possible instead. */
+func replaySession(path, target string, speed float64, nowait bool) error {
+	recs, err := readOwmRecords(path)
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", path, err)
+	}
+	if 0 == len(recs) {
+		return nil
+	}
+
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("connecting to %v: %w", target, err)
+	}
+	defer conn.Close()
+
+	prev := recs[0].at
+	for _, rec := range recs {
+		if !nowait {
+			sleepScaled(rec.at.Sub(prev), speed)
+		}
+		prev = rec.at
+		if !rec.in {
+			/* 'o' packets are what came back; nothing to send */
+			continue
+		}
+		if _, err := conn.Write(rec.data); err != nil {
+			return fmt.Errorf("writing %v-byte packet: %w",
+				len(rec.data), err)
+		}
+	}
+	return nil
+}
+
+/* verifySession reads the .owm file at path, reconnects to target, and
+replays its 'i' packets while reading the mirrored response back in
+buflen-sized chunks (matching proxyBytes), comparing it against the
+recorded 'o' packets.  A non-nil error describes the first mismatch. */
+func verifySession(path, target string, buflen int) error {
+	recs, err := readOwmRecords(path)
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", path, err)
+	}
+
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("connecting to %v: %w", target, err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, buflen)
+	for i, rec := range recs {
+		if rec.in {
+			if _, err := conn.Write(rec.data); err != nil {
+				return fmt.Errorf("writing %v-byte packet "+
+					"%v: %w", len(rec.data), i, err)
+			}
+			continue
+		}
+		got := make([]byte, 0, len(rec.data))
+		for len(got) < len(rec.data) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return fmt.Errorf("reading packet %v: %w", i,
+					err)
+			}
+			got = append(got, buf[:n]...)
+		}
+		if !bytes.Equal(got, rec.data) {
+			return fmt.Errorf("packet %v: mirrored bytes don't "+
+				"match recorded session", i)
+		}
+	}
+	return nil
+}
+
+/* sleepScaled sleeps for d scaled by 1/speed, or not at all if d isn't
+positive. */
+func sleepScaled(d time.Duration, speed float64) {
+	if d <= 0 {
+		return
+	}
+	if speed > 0 {
+		d = time.Duration(float64(d) / speed)
+	}
+	time.Sleep(d)
+}
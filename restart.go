@@ -0,0 +1,443 @@
+//go:build unix
+
+package main
+
+/*
+ * restart.go
+ * Graceful restart (SIGUSR2) with live-session handoff via SCM_RIGHTS
+ * by J. Stuart McMurray
+ * created 20140530
+ * last modified 20140530
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* restartFDEnv is set in the child's environment to the FD number of its
+end of the control socketpair when it's being handed sessions by a
+graceful restart, rather than started fresh. */
+const restartFDEnv = "ONEWAYMIRROR_RESTART_FD"
+
+/* restartAckTimeout bounds how long the parent will wait for the child to
+acknowledge receipt of the manifest and FDs before giving up on the
+restart (the sessions it already stopped reading are, at that point,
+simply stuck; see the comment in restart()). */
+const restartAckTimeout = 10 * time.Second
+
+/* restartDrainTimeout bounds how long restart() waits for a session's
+proxyBytes goroutines to notice their deadline and return before handing
+its FDs off anyway. */
+const restartDrainTimeout = 2 * time.Second
+
+/* listenerInfo records which address family a listener FD, sent to a
+restart child, belongs to. */
+type listenerInfo struct {
+	Network string `json:"network"` /* "tcp4" or "tcp6" */
+}
+
+/* fdInfo describes one inherited connection in a restart manifest.  FDs
+are sent over the control socket via SCM_RIGHTS in the same order as
+their fdInfo entries: listener FDs (per restartManifest.Listeners) first,
+then, for every restartManifest.Sessions entry, the client FD (role
+"client") followed by the target FD (role "target"). */
+type fdInfo struct {
+	SessionID string `json:"session_id"`
+	Dir       string `json:"dir"` /* logdir/<target IP>, or "" if disabled */
+	Rad       string `json:"rad"`
+	Lad       string `json:"lad"`
+	Tproxy    bool   `json:"tproxy"`
+	RRead     int64  `json:"r_read"`    /* role "client" read/written */
+	RWritten  int64  `json:"r_written"`
+	TRead     int64  `json:"t_read"`    /* role "target" read/written */
+	TWritten  int64  `json:"t_written"`
+}
+
+/* restartManifest is sent, as JSON, alongside the FDs it describes, when
+handing a running server off to its restart child. */
+type restartManifest struct {
+	Listeners []listenerInfo `json:"listeners"`
+	Sessions  []fdInfo       `json:"sessions"`
+}
+
+/* installRestartHandler arranges for SIGUSR2 to trigger a graceful
+restart of srv: re-exec'ing this binary and handing the new process
+srv's listeners and live sessions over a control socketpair, so neither
+new connections nor in-flight ones are dropped across an upgrade. */
+func installRestartHandler(srv *server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			log.Printf("SIGUSR2 received; attempting a graceful " +
+				"restart")
+			if err := srv.restart(); err != nil {
+				log.Printf("Graceful restart failed, "+
+					"continuing to run: %v", err)
+			}
+		}
+	}()
+}
+
+/* restart re-execs the running binary, handing the child every listener
+and live session srv knows about via a control socketpair, then exits
+once the child acknowledges receipt.  On failure before any session's
+been stopped, srv is left running unmodified; a failure afterwards (e.g.
+the child fails to start) leaves those sessions' bytes un-proxied, since
+there's no simple way to resume reading them locally once we've stopped
+-- see the TODO below. */
+func (srv *server) restart() error {
+	srv.mu.Lock()
+	sessions := make([]*session, 0, len(srv.sessions))
+	for _, s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	srv.mu.Unlock()
+
+	/* Stop reading/writing every session ourselves and wait for both
+	of its proxyBytes goroutines to notice and return, so we're not
+	racing the child to read the same bytes once it takes over.  Any
+	bytes already sitting in a socket's receive buffer stay there,
+	unread, for the child to pick up; nothing in flight is lost. */
+	/* TODO: if the handoff below fails, these sessions are stuck with
+	nobody reading them; there's no good way to un-stop them short of
+	relaunching proxyBytes locally, which isn't done here. */
+	for _, s := range sessions {
+		now := time.Now()
+		s.r.SetDeadline(now)
+		s.t.SetDeadline(now)
+	}
+	for _, s := range sessions {
+		waitWG(&s.wg, restartDrainTimeout)
+	}
+
+	var linfos []listenerInfo
+	var lfiles []*os.File
+	for _, l := range []*net.TCPListener{srv.l4, srv.l6} {
+		if l == nil {
+			continue
+		}
+		f, err := l.File()
+		if err != nil {
+			return fmt.Errorf("duplicating listener %v: %w",
+				l.Addr(), err)
+		}
+		network := "tcp6"
+		if ta, ok := l.Addr().(*net.TCPAddr); ok && nil != ta.IP.To4() {
+			network = "tcp4"
+		}
+		lfiles = append(lfiles, f)
+		linfos = append(linfos, listenerInfo{Network: network})
+	}
+
+	var sinfos []fdInfo
+	var sfiles []*os.File
+	for _, s := range sessions {
+		rf, err := s.r.File()
+		if err != nil {
+			return fmt.Errorf("duplicating client FD for "+
+				"session %v: %w", s.id, err)
+		}
+		tf, err := s.t.File()
+		if err != nil {
+			return fmt.Errorf("duplicating target FD for "+
+				"session %v: %w", s.id, err)
+		}
+		sfiles = append(sfiles, rf, tf)
+		sinfos = append(sinfos, fdInfo{
+			SessionID: s.id,
+			Dir:       s.dir,
+			Rad:       s.rad.String(),
+			Lad:       s.lad.String(),
+			Tproxy:    s.tproxy,
+			RRead:     s.rRead.Load(),
+			RWritten:  s.rWritten.Load(),
+			TRead:     s.tRead.Load(),
+			TWritten:  s.tWritten.Load(),
+		})
+	}
+
+	manifest, err := json.Marshal(restartManifest{
+		Listeners: linfos,
+		Sessions:  sinfos,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling restart manifest: %w", err)
+	}
+
+	/* Control socketpair: we keep one end, the child gets the other
+	as an inherited FD. */
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return fmt.Errorf("making control socketpair: %w", err)
+	}
+	parentFile := os.NewFile(uintptr(fds[0]), "restart-parent")
+	childFile := os.NewFile(uintptr(fds[1]), "restart-child")
+	defer parentFile.Close()
+	defer childFile.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding our own executable: %w", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{childFile}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%v=3", restartFDEnv))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting restart child: %w", err)
+	}
+
+	pconn, err := net.FileConn(parentFile)
+	if err != nil {
+		return fmt.Errorf("wrapping control socket: %w", err)
+	}
+	defer pconn.Close()
+	uconn, ok := pconn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("control socket isn't a unix conn")
+	}
+
+	allFiles := append(append([]*os.File{}, lfiles...), sfiles...)
+	cfds := make([]int, 0, len(allFiles))
+	for _, f := range allFiles {
+		cfds = append(cfds, int(f.Fd()))
+	}
+	rights := syscall.UnixRights(cfds...)
+	if _, _, err := uconn.WriteMsgUnix(manifest, rights, nil); err != nil {
+		return fmt.Errorf("sending manifest and FDs to child: %w", err)
+	}
+	for _, f := range allFiles {
+		f.Close()
+	}
+
+	uconn.SetReadDeadline(time.Now().Add(restartAckTimeout))
+	ack := make([]byte, 1)
+	if _, err := uconn.Read(ack); err != nil {
+		return fmt.Errorf("waiting for child's ACK: %w", err)
+	}
+
+	log.Printf("Handed off %v listener(s) and %v session(s) to pid %v; "+
+		"exiting", len(lfiles), len(sfiles), cmd.Process.Pid)
+	os.Exit(0)
+	return nil
+}
+
+/* waitWG waits for wg to reach zero, giving up silently after timeout. */
+func waitWG(wg *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+/* restarting returns the FD of the control socket our parent passed us,
+and true, if we were started as the child of a graceful restart. */
+func restarting() (int, bool) {
+	v := os.Getenv(restartFDEnv)
+	if v == "" {
+		return 0, false
+	}
+	var fd int
+	if _, err := fmt.Sscanf(v, "%d", &fd); err != nil {
+		return 0, false
+	}
+	return fd, true
+}
+
+/* resumeFromRestart reads the manifest and FDs our parent sent over the
+control socket at fd, populates srv's listeners and sessions from them,
+ACKs receipt, and starts proxyBytes/runSink running again for every
+resumed session exactly where the parent left off. */
+func resumeFromRestart(fd int, srv *server) error {
+	cf := os.NewFile(uintptr(fd), "restart-child")
+	defer cf.Close()
+	conn, err := net.FileConn(cf)
+	if err != nil {
+		return fmt.Errorf("wrapping control socket: %w", err)
+	}
+	defer conn.Close()
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("control socket isn't a unix conn")
+	}
+
+	data := make([]byte, 64*1024)
+	oob := make([]byte, 4096)
+	n, oobn, _, _, err := uconn.ReadMsgUnix(data, oob)
+	if err != nil {
+		return fmt.Errorf("reading manifest and FDs: %w", err)
+	}
+
+	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return fmt.Errorf("parsing control message: %w", err)
+	}
+	var allfds []int
+	for _, scm := range scms {
+		fds, err := syscall.ParseUnixRights(&scm)
+		if err != nil {
+			return fmt.Errorf("parsing passed FDs: %w", err)
+		}
+		allfds = append(allfds, fds...)
+	}
+
+	var m restartManifest
+	if err := json.Unmarshal(data[:n], &m); err != nil {
+		return fmt.Errorf("unmarshaling manifest: %w", err)
+	}
+	if len(allfds) != len(m.Listeners)+2*len(m.Sessions) {
+		return fmt.Errorf("got %v FDs for %v listener(s) and %v "+
+			"session(s)", len(allfds), len(m.Listeners),
+			len(m.Sessions))
+	}
+
+	i := 0
+	for _, li := range m.Listeners {
+		f := os.NewFile(uintptr(allfds[i]), "inherited-listener")
+		i++
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("wrapping inherited listener: %w", err)
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			return fmt.Errorf("inherited listener isn't TCP")
+		}
+		switch li.Network {
+		case "tcp4":
+			srv.l4 = tl
+		case "tcp6":
+			srv.l6 = tl
+		default:
+			tl.Close()
+			return fmt.Errorf("unknown listener network %q",
+				li.Network)
+		}
+	}
+
+	for _, si := range m.Sessions {
+		rf := os.NewFile(uintptr(allfds[i]), "inherited-client")
+		i++
+		tfile := os.NewFile(uintptr(allfds[i]), "inherited-target")
+		i++
+		rc, err := net.FileConn(rf)
+		rf.Close()
+		if err != nil {
+			return fmt.Errorf("wrapping inherited client FD: %w",
+				err)
+		}
+		tc, err := net.FileConn(tfile)
+		tfile.Close()
+		if err != nil {
+			return fmt.Errorf("wrapping inherited target FD: %w",
+				err)
+		}
+		r, ok := rc.(*net.TCPConn)
+		if !ok {
+			return fmt.Errorf("inherited client FD isn't TCP")
+		}
+		t, ok := tc.(*net.TCPConn)
+		if !ok {
+			return fmt.Errorf("inherited target FD isn't TCP")
+		}
+		rad, err := net.ResolveTCPAddr("tcp", si.Rad)
+		if err != nil {
+			return fmt.Errorf("parsing resumed client addr %q: %w",
+				si.Rad, err)
+		}
+		lad, err := net.ResolveTCPAddr("tcp", si.Lad)
+		if err != nil {
+			return fmt.Errorf("parsing resumed listener addr %q: "+
+				"%w", si.Lad, err)
+		}
+		resumeSession(srv, si, r, t, rad, lad)
+	}
+
+	if _, err := uconn.Write([]byte{1}); err != nil {
+		return fmt.Errorf("ACKing restart: %w", err)
+	}
+	log.Printf("Resumed %v listener(s) and %v session(s) from a "+
+		"graceful restart", len(m.Listeners), len(m.Sessions))
+	return nil
+}
+
+/* resumeSession recreates the goroutines handleConn would have started
+for a session described by si, using the inherited r and t conns and
+continuing si's byte counters and, if srv.sink is set, its session
+logging, where the parent left off. */
+func resumeSession(srv *server, si fdInfo, r, t *net.TCPConn, rad, lad *net.TCPAddr) {
+	s := &session{
+		id:     si.SessionID,
+		dir:    si.Dir,
+		rad:    rad,
+		lad:    lad,
+		tproxy: si.Tproxy,
+		r:      r,
+		t:      t,
+	}
+	s.rRead.Store(si.RRead)
+	s.rWritten.Store(si.RWritten)
+	s.tRead.Store(si.TRead)
+	s.tWritten.Store(si.TWritten)
+	srv.registerSession(s)
+
+	constr := fmt.Sprintf("%v -> %v", r.RemoteAddr(), r.LocalAddr())
+	tgtstr := fmt.Sprintf("%v -> %v", t.LocalAddr(), t.RemoteAddr())
+
+	var in, out chan packet
+	if srv.sink != nil {
+		if logger, err := srv.sink.Open(SessionMeta{
+			ID:     s.id,
+			Dir:    s.dir,
+			Rad:    s.rad,
+			Lad:    s.lad,
+			Resume: true,
+			CSeq:   1 + uint32(si.RRead),
+			SSeq:   1 + uint32(si.TRead),
+		}); err != nil {
+			log.Printf("Unable to resume logging of session %v: %v",
+				s.id, err)
+		} else if logger != nil {
+			in = make(chan packet)
+			out = make(chan packet)
+			go runSink(in, out, logger)
+		}
+	}
+
+	s.wg.Add(2)
+	done := make(chan *net.TCPConn)
+	go proxyBytes(r, t, done, srv.buflen, constr, in, &s.wg, &s.rRead,
+		&s.rWritten)
+	go proxyBytes(t, r, done, srv.buflen, tgtstr, out, &s.wg, &s.tRead,
+		&s.tWritten)
+
+	go func() {
+		defer r.Close()
+		defer t.Close()
+		if in != nil {
+			defer close(in)
+			defer close(out)
+		}
+		defer srv.unregisterSession(s.id)
+		<-done
+	}()
+}
@@ -0,0 +1,30 @@
+//go:build !unix
+
+package main
+
+/*
+ * restart_other.go
+ * Stub graceful-restart support for non-unix platforms
+ * by J. Stuart McMurray
+ * created 20140530
+ * last modified 20140530
+ */
+
+import "log"
+
+/* installRestartHandler, restarting, and resumeFromRestart are only
+implemented on unix, where SCM_RIGHTS and socketpairs are available.  On
+other platforms, graceful restart is simply unavailable: SIGUSR2 isn't
+defined and a restart can never be in progress. */
+
+func installRestartHandler(srv *server) {
+	log.Printf("Graceful restart (SIGUSR2) is only supported on unix")
+}
+
+func restarting() (int, bool) {
+	return 0, false
+}
+
+func resumeFromRestart(fd int, srv *server) error {
+	panic("resumeFromRestart called on a platform without restart support")
+}
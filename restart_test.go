@@ -0,0 +1,147 @@
+//go:build unix
+
+package main
+
+/*
+ * restart_test.go
+ * Verify no bytes are lost handing a live connection's FD across a
+ * control socketpair, the way restart()/resumeFromRestart() do
+ * by J. Stuart McMurray
+ * created 20140601
+ * last modified 20140601
+ */
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+/* sendFD sends f's FD to the other end of an AF_UNIX SOCK_STREAM
+socketpair via SCM_RIGHTS, mirroring what restart() does with session
+and listener FDs. */
+func sendFD(t *testing.T, uconn *net.UnixConn, f *os.File) {
+	t.Helper()
+	rights := syscall.UnixRights(int(f.Fd()))
+	if _, _, err := uconn.WriteMsgUnix(nil, rights, nil); err != nil {
+		t.Fatalf("sending FD: %v", err)
+	}
+}
+
+/* recvFD reads one FD sent by sendFD off uconn, mirroring what
+resumeFromRestart() does to recover inherited connections. */
+func recvFD(t *testing.T, uconn *net.UnixConn) *os.File {
+	t.Helper()
+	oob := make([]byte, 32)
+	_, oobn, _, _, err := uconn.ReadMsgUnix(nil, oob)
+	if err != nil {
+		t.Fatalf("reading FD: %v", err)
+	}
+	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		t.Fatalf("parsing control message: %v", err)
+	}
+	if len(scms) != 1 {
+		t.Fatalf("got %v control messages, want 1", len(scms))
+	}
+	fds, err := syscall.ParseUnixRights(&scms[0])
+	if err != nil {
+		t.Fatalf("parsing passed FD: %v", err)
+	}
+	if len(fds) != 1 {
+		t.Fatalf("got %v FDs, want 1", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), "received-fd")
+}
+
+/* TestRestartHandoffNoDataLoss verifies that bytes written to a TCP
+connection before its FD is handed off over an in-process control
+socketpair -- and left unread by the "parent", as restart() leaves them
+for a session it's stopped reading -- are neither lost nor duplicated
+once the "child" resumes reading from the handed-off FD, and that bytes
+written after the handoff arrive too. */
+func TestRestartHandoffNoDataLoss(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer client.Close()
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accepting: %v", err)
+	}
+	server, ok := accepted.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("accepted conn isn't TCP")
+	}
+
+	const before = "bytes written before the handoff"
+	if _, err := client.Write([]byte(before)); err != nil {
+		t.Fatalf("writing before handoff: %v", err)
+	}
+
+	/* Duplicate server's FD the way restart() does via (*net.TCPConn).File,
+	then close our reference to the original conn without reading
+	anything from it, simulating restart()'s deadline-stopped session. */
+	sf, err := server.File()
+	if err != nil {
+		t.Fatalf("duplicating server FD: %v", err)
+	}
+	server.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("making control socketpair: %v", err)
+	}
+	pf := os.NewFile(uintptr(fds[0]), "control-parent")
+	cf := os.NewFile(uintptr(fds[1]), "control-child")
+	defer pf.Close()
+	defer cf.Close()
+	pconn, err := net.FileConn(pf)
+	if err != nil {
+		t.Fatalf("wrapping parent control FD: %v", err)
+	}
+	defer pconn.Close()
+	cconn, err := net.FileConn(cf)
+	if err != nil {
+		t.Fatalf("wrapping child control FD: %v", err)
+	}
+	defer cconn.Close()
+	puconn := pconn.(*net.UnixConn)
+	cuconn := cconn.(*net.UnixConn)
+
+	sendFD(t, puconn, sf)
+	sf.Close()
+	rf := recvFD(t, cuconn)
+
+	rc, err := net.FileConn(rf)
+	if err != nil {
+		t.Fatalf("wrapping received FD: %v", err)
+	}
+	defer rc.Close()
+	rf.Close()
+
+	const after = "bytes written after the handoff"
+	if _, err := client.Write([]byte(after)); err != nil {
+		t.Fatalf("writing after handoff: %v", err)
+	}
+
+	want := before + after
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(rc, got); err != nil {
+		t.Fatalf("reading resumed conn: %v", err)
+	}
+	if !bytes.Equal(got, []byte(want)) {
+		t.Fatalf("resumed conn read %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,763 @@
+package main
+
+/*
+ * sink.go
+ * Pluggable session-storage sinks (-sink)
+ * by J. Stuart McMurray
+ * created 20140601
+ * last modified 20140601
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* packet represents a packet, as read by proxyBytes and handed to a
+SessionLogger. */
+type packet struct {
+	data   []byte
+	length int
+}
+
+/* SessionMeta describes one session to a SessionSink's Open, so sinks can
+decide where and how to store it without handleConn knowing any
+sink-specific details. */
+type SessionMeta struct {
+	ID     string       /* Unique session ID */
+	Dir    string       /* logdir/<target IP>, or "" if no on-disk dir applies */
+	Rad    *net.TCPAddr /* Client (remote) address */
+	Lad    *net.TCPAddr /* Listener (local) address */
+	Resume bool         /* True if resuming a session handed off by a graceful restart */
+	CSeq   uint32       /* Fabricated client sequence number to resume at, if Resume */
+	SSeq   uint32       /* Fabricated server sequence number to resume at, if Resume */
+}
+
+/* SessionLogger is returned by SessionSink.Open to receive the packets of
+one session as they're mirrored, and is closed once the session ends. */
+type SessionLogger interface {
+	/* LogPacket logs p, read at t, in direction toTarget (true:
+	client -> target, false: target -> client). */
+	LogPacket(p packet, toTarget bool, t time.Time)
+	/* Close flushes and releases any resources held for the session. */
+	Close()
+}
+
+/* SessionSink is the interface implemented by session-storage backends.
+Open is called once per session, before any packets are logged; a nil
+SessionLogger and nil error means the sink has nothing to do for this
+session (as opposed to an error, which is merely logged and otherwise
+ignored by handleConn). */
+type SessionSink interface {
+	Open(meta SessionMeta) (SessionLogger, error)
+}
+
+/* sinkFlag collects every -sink flag given on the command line, each a
+name[,key=val,...] sink specification.  Repeating -sink composes the
+named sinks, via a teeSink, so a session can be logged to more than one
+place at once. */
+type sinkFlag []string
+
+func (f *sinkFlag) String() string { return strings.Join(*f, ";") }
+
+func (f *sinkFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+/* buildSink turns the -sink specs into a single SessionSink, teeing to
+all of them if more than one was given.  With no specs at all, it
+reproduces onewaymirror's long-standing default: a single on-disk
+.owm/pcap/pcapng sink using logDir and logFmt. */
+func buildSink(specs []string, logDir *string, logFmt logFormat) (SessionSink, error) {
+	if len(specs) == 0 {
+		return &fileSink{logFmt: logFmt}, nil
+	}
+	sinks := make([]SessionSink, 0, len(specs))
+	for _, spec := range specs {
+		s, err := newSink(spec, logDir, logFmt)
+		if err != nil {
+			return nil, fmt.Errorf("-sink %q: %w", spec, err)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return teeSink(sinks), nil
+}
+
+/* newSink parses one name[,key=val,...] -sink spec and constructs the
+named SessionSink.  logDir and logFmt supply defaults for sinks that, like
+onewaymirror's original logging, are rooted in a directory on disk. */
+func newSink(spec string, logDir *string, logFmt logFormat) (SessionSink, error) {
+	name, opts, err := parseSinkSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "", "file":
+		fmtv := logFmt
+		if v, ok := opts["logfmt"]; ok {
+			if fmtv, err = parseLogFormat(v); err != nil {
+				return nil, err
+			}
+		}
+		return &fileSink{logFmt: fmtv, dir: opts["dir"]}, nil
+	case "rotate":
+		return newRotatingSink(opts, logDir, logFmt)
+	case "jsonl":
+		return newJSONLSink(opts, logDir)
+	case "http", "s3":
+		return newHTTPSink(opts)
+	}
+	return nil, fmt.Errorf("unknown sink %q", name)
+}
+
+/* parseSinkSpec splits a name[,key=val,...] -sink spec into its name and
+its options. */
+func parseSinkSpec(spec string) (string, map[string]string, error) {
+	parts := strings.Split(spec, ",")
+	opts := make(map[string]string, len(parts)-1)
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", nil, fmt.Errorf("invalid option %q (want key=val)", p)
+		}
+		opts[kv[0]] = kv[1]
+	}
+	return parts[0], opts, nil
+}
+
+/* runSink drains in and out, handing each packet read from them to
+logger.LogPacket, until both are closed (i.e. both of a session's
+proxyBytes goroutines have returned), then closes logger. */
+func runSink(in, out chan packet, logger SessionLogger) {
+	defer logger.Close()
+	var iclosed, oclosed bool
+	for {
+		if iclosed && oclosed {
+			return
+		}
+		select {
+		case p, ok := <-in:
+			if !ok {
+				iclosed = true
+				continue
+			}
+			logger.LogPacket(p, true, time.Now())
+		case p, ok := <-out:
+			if !ok {
+				oclosed = true
+				continue
+			}
+			logger.LogPacket(p, false, time.Now())
+		}
+	}
+}
+
+/* owmRecord renders p, read at t in direction toTarget (true: client ->
+target, logged as 'i'; false: target -> client, logged as 'o'), in the
+on-disk .owm wire format: a newline-prefixed tab-separated metadata line
+followed immediately by the raw payload. */
+func owmRecord(p packet, toTarget bool, t time.Time) []byte {
+	dc := 'o'
+	if toTarget {
+		dc = 'i'
+	}
+	s := fmt.Sprintf("\n%v\t%v.%v\t%c\t%v\t", t.Format(time.StampNano),
+		t.Unix(), t.Nanosecond(), dc, p.length)
+	return append([]byte(s), p.data[:p.length]...)
+}
+
+/* openLogFile opens a log file or prints an error and returns nil.  excl
+adds O_EXCL, guarding against two sessions colliding on the same
+generated filename; it must be false when reopening a resumed session's
+own file across a graceful restart, since that file is expected to
+already exist. */
+func openLogFile(dir, name string, excl bool) *os.File {
+	/* TODO: Unhardcode modes */
+	/* Make sure directory exists */
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Unable to create directory %v: %v", dir, err)
+		return nil
+	}
+
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	if excl {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path.Join(dir, name), flags, 0644)
+	if err != nil {
+		log.Printf("Unable to open %v: %v", name, err)
+		return nil
+	}
+	return f
+}
+
+/* fileSink is the on-disk .owm/pcap/pcapng sink onewaymirror's always
+used, one set of files per session under dir (or, if dir is empty, under
+whatever SessionMeta.Dir Open is given). */
+type fileSink struct {
+	logFmt logFormat
+	dir    string /* Overrides SessionMeta.Dir if not empty */
+}
+
+/* Open implements SessionSink. */
+func (fs *fileSink) Open(meta SessionMeta) (SessionLogger, error) {
+	dir := meta.Dir
+	if fs.dir != "" {
+		dir = fs.dir
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("no directory for session %v", meta.ID)
+	}
+
+	fl := &fileLogger{rad: meta.Rad, lad: meta.Lad}
+	excl := !meta.Resume
+	if 0 != fs.logFmt&logOWM {
+		fl.olog = openLogFile(dir, meta.ID+".owm", excl)
+	}
+	if 0 != fs.logFmt&logPCAP {
+		fl.pcapf = openLogFile(dir, meta.ID+".pcap", excl)
+		if fl.pcapf != nil && !meta.Resume {
+			if err := writePcapGlobalHeader(fl.pcapf); err != nil {
+				log.Printf("Unable to write pcap header to "+
+					"%v: %v", fl.pcapf.Name(), err)
+				fl.pcapf.Close()
+				fl.pcapf = nil
+			}
+		}
+	}
+	if 0 != fs.logFmt&logPCAPNG {
+		fl.pcapngf = openLogFile(dir, meta.ID+".pcapng", excl)
+		if fl.pcapngf != nil && !meta.Resume {
+			if err := writePcapngSHB(fl.pcapngf); err != nil ||
+				nil != writePcapngIDB(fl.pcapngf) {
+				log.Printf("Unable to write pcapng headers "+
+					"to %v: %v", fl.pcapngf.Name(), err)
+				fl.pcapngf.Close()
+				fl.pcapngf = nil
+			}
+		}
+	}
+
+	/* A resumed session's files already have their headers and
+	handshake preamble from before the restart; just pick its
+	fabricated sequence numbers back up where the parent left off. */
+	if meta.Resume {
+		fl.cseq, fl.sseq = meta.CSeq, meta.SSeq
+		return fl, nil
+	}
+
+	/* Fabricated SYN/SYN-ACK/ACK preamble */
+	start := time.Now()
+	fl.writeSeg(start, true, tcpSYN, nil)
+	fl.cseq++
+	fl.writeSeg(start, false, tcpSYN|tcpACK, nil)
+	fl.sseq++
+	fl.writeSeg(start, true, tcpACK, nil)
+
+	return fl, nil
+}
+
+/* fileLogger is the SessionLogger returned by fileSink.Open. */
+type fileLogger struct {
+	olog, pcapf, pcapngf *os.File
+	rad, lad             *net.TCPAddr
+	cseq, sseq           uint32 /* Fabricated TCP sequence numbers, one per side */
+}
+
+/* writeSeg fabricates a single TCP segment as if sent by the client (if
+client is true) or the target, and appends it to whichever of pcapf and
+pcapngf are open.  The segment's ack is simply the peer's counter, since
+Open and Close already bump cseq/sseq past the fabricated SYN/FIN they
+write before calling writeSeg for the next segment. */
+func (fl *fileLogger) writeSeg(t time.Time, client bool, flags uint8, payload []byte) {
+	if nil == fl.pcapf && nil == fl.pcapngf {
+		return
+	}
+	src, dst := fl.rad, fl.lad
+	seq, ack := fl.cseq, fl.sseq
+	if !client {
+		src, dst = fl.lad, fl.rad
+		seq, ack = fl.sseq, fl.cseq
+	}
+	seg, err := tcpSegment(src, dst, seq, ack, flags, payload)
+	if client {
+		fl.cseq += uint32(len(payload))
+	} else {
+		fl.sseq += uint32(len(payload))
+	}
+	if err != nil {
+		log.Printf("Unable to fabricate a TCP segment for %v -> %v: %v",
+			src, dst, err)
+		return
+	}
+	if fl.pcapf != nil {
+		if err := writePcapRecord(fl.pcapf, t, seg); err != nil {
+			log.Printf("Unable to write to %v: %v", fl.pcapf.Name(), err)
+		}
+	}
+	if fl.pcapngf != nil {
+		if err := writePcapngEPB(fl.pcapngf, t, seg); err != nil {
+			log.Printf("Unable to write to %v: %v", fl.pcapngf.Name(), err)
+		}
+	}
+}
+
+/* LogPacket implements SessionLogger. */
+func (fl *fileLogger) LogPacket(p packet, toTarget bool, t time.Time) {
+	if fl.olog != nil {
+		if n, err := fl.olog.Write(owmRecord(p, toTarget, t)); err != nil {
+			log.Printf("Only wrote %v bytes of a packet to %v: %v",
+				n, fl.olog.Name(), err)
+			fl.olog.Close()
+			fl.olog = nil
+		}
+	}
+	fl.writeSeg(t, toTarget, tcpACK, p.data[:p.length])
+}
+
+/* Close implements SessionLogger. */
+func (fl *fileLogger) Close() {
+	now := time.Now()
+	fl.writeSeg(now, true, tcpFIN|tcpACK, nil)
+	fl.cseq++
+	fl.writeSeg(now, false, tcpFIN|tcpACK, nil)
+	fl.sseq++
+	for _, f := range []*os.File{fl.olog, fl.pcapf, fl.pcapngf} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+/* rotatingSink wraps a fileSink, evicting the oldest sessions' log files
+under evictDir once maxSessions or maxAge is exceeded, and capping how
+much any one session's on-disk logs grow once maxSize is exceeded. */
+type rotatingSink struct {
+	inner    *fileSink
+	evictDir string /* Root directory evict() scans */
+
+	maxSize     int64         /* Bytes; 0 disables the cap */
+	maxSessions int           /* 0 disables the cap */
+	maxAge      time.Duration /* 0 disables the cap */
+
+	mu sync.Mutex
+}
+
+/* newRotatingSink builds a rotatingSink from a rotate -sink spec's
+options: dir (default logDir), logfmt (default logFmt), maxsize (e.g.
+"100MB"), maxsessions and maxage (e.g. "24h"). */
+func newRotatingSink(opts map[string]string, logDir *string, logFmt logFormat) (SessionSink, error) {
+	dir := opts["dir"]
+	evictDir := dir
+	if evictDir == "" {
+		if logDir == nil {
+			return nil, fmt.Errorf("no directory (set dir= or -logdir)")
+		}
+		evictDir = *logDir
+	}
+	fmtv := logFmt
+	if v, ok := opts["logfmt"]; ok {
+		var err error
+		if fmtv, err = parseLogFormat(v); err != nil {
+			return nil, err
+		}
+	}
+	rs := &rotatingSink{
+		inner:    &fileSink{logFmt: fmtv, dir: dir},
+		evictDir: evictDir,
+	}
+	if v, ok := opts["maxsize"]; ok {
+		n, err := parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("maxsize: %w", err)
+		}
+		rs.maxSize = n
+	}
+	if v, ok := opts["maxsessions"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("maxsessions: %w", err)
+		}
+		rs.maxSessions = n
+	}
+	if v, ok := opts["maxage"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("maxage: %w", err)
+		}
+		rs.maxAge = d
+	}
+	return rs, nil
+}
+
+/* Open implements SessionSink.  The dir= override, if any, was passed
+straight to rs.inner at construction, so it takes the same precedence
+over meta.Dir there that a plain -sink file,dir=... would. */
+func (rs *rotatingSink) Open(meta SessionMeta) (SessionLogger, error) {
+	rs.mu.Lock()
+	rs.evict()
+	rs.mu.Unlock()
+
+	logger, err := rs.inner.Open(meta)
+	if err != nil || logger == nil || rs.maxSize <= 0 {
+		return logger, err
+	}
+	return &sizeCappedLogger{SessionLogger: logger, id: meta.ID, max: rs.maxSize}, nil
+}
+
+/* sessionFiles is one session's on-disk log files (its .owm, .pcap
+and/or .pcapng, all named <session ID>.<ext>), grouped so eviction
+removes or keeps a whole session at once no matter how many files it
+left behind. */
+type sessionFiles struct {
+	paths []string
+	age   time.Time
+}
+
+/* addSessionFile records f, found directly under parent, in bySession,
+recovering the session's age from its ID (the part of its filename
+before its first '.'), which is a time.RFC3339Nano timestamp (see
+handleConn), falling back to f's mtime if that fails to parse. */
+func addSessionFile(bySession map[string]*sessionFiles, parent string, f os.DirEntry) {
+	id := f.Name()
+	if i := strings.IndexByte(id, '.'); i >= 0 {
+		id = id[:i]
+	}
+	key := path.Join(parent, id)
+	sf := bySession[key]
+	if sf == nil {
+		sf = &sessionFiles{}
+		if t, err := time.Parse(time.RFC3339Nano, id); err == nil {
+			sf.age = t
+		} else if info, err := f.Info(); err == nil {
+			sf.age = info.ModTime()
+		}
+		bySession[key] = sf
+	}
+	sf.paths = append(sf.paths, path.Join(parent, f.Name()))
+}
+
+/* listSessions groups every log file found under dir by session,
+recovering each session's age from its ID so that aging and eviction
+never depend on a shared directory's mtime.  It understands both
+layouts a fileSink can be told to use: files directly under dir, as
+when an explicit dir= override is given (and so not split per target
+IP), and files nested one level down in per-target-IP subdirectories of
+dir, onewaymirror's long-standing default layout.  Either way, a single
+target IP (or a single custom dir) accumulating many short-lived
+sessions doesn't keep anything shared fresh enough to dodge eviction;
+each session is evicted (or not) on its own age, independent of its
+neighbours. */
+func listSessions(dir string) []sessionFiles {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	bySession := make(map[string]*sessionFiles)
+	for _, e := range ents {
+		if !e.IsDir() {
+			addSessionFile(bySession, dir, e)
+			continue
+		}
+		ipPath := path.Join(dir, e.Name())
+		files, err := os.ReadDir(ipPath)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			addSessionFile(bySession, ipPath, f)
+		}
+	}
+	sessions := make([]sessionFiles, 0, len(bySession))
+	for _, sf := range bySession {
+		sessions = append(sessions, *sf)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].age.Before(sessions[j].age) })
+	return sessions
+}
+
+/* removeSession deletes every file belonging to s. */
+func removeSession(s sessionFiles) {
+	for _, p := range s.paths {
+		if err := os.Remove(p); err != nil {
+			log.Printf("Unable to evict %v: %v", p, err)
+		}
+	}
+}
+
+/* evict removes sessions older than rs.maxAge, then removes the oldest
+remaining ones until at most rs.maxSessions are left.  rs.mu must be
+held. */
+func (rs *rotatingSink) evict() {
+	if rs.maxAge <= 0 && rs.maxSessions <= 0 {
+		return
+	}
+	sessions := listSessions(rs.evictDir)
+	if rs.maxAge > 0 {
+		now := time.Now()
+		kept := sessions[:0]
+		for _, s := range sessions {
+			if now.Sub(s.age) > rs.maxAge {
+				removeSession(s)
+				continue
+			}
+			kept = append(kept, s)
+		}
+		sessions = kept
+	}
+	if rs.maxSessions > 0 {
+		for len(sessions) > rs.maxSessions {
+			removeSession(sessions[0])
+			sessions = sessions[1:]
+		}
+	}
+}
+
+/* parseSize parses a byte count with an optional KB/MB/GB suffix. */
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	u := strings.ToUpper(strings.TrimSpace(s))
+	for suffix, m := range map[string]int64{"GB": 1 << 30, "MB": 1 << 20, "KB": 1 << 10} {
+		if strings.HasSuffix(u, suffix) {
+			mult = m
+			u = strings.TrimSuffix(u, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(u), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+/* sizeCappedLogger wraps another SessionLogger, silently dropping
+packets once max bytes have been logged through it, so a single session
+can't grow its on-disk logs without bound. */
+type sizeCappedLogger struct {
+	SessionLogger
+	id      string
+	max     int64
+	written int64
+	capped  bool
+}
+
+/* LogPacket implements SessionLogger. */
+func (l *sizeCappedLogger) LogPacket(p packet, toTarget bool, t time.Time) {
+	if l.capped {
+		return
+	}
+	l.written += int64(p.length)
+	if l.written > l.max {
+		l.capped = true
+		log.Printf("Session %v exceeded -maxsize; no longer logging it",
+			l.id)
+		return
+	}
+	l.SessionLogger.LogPacket(p, toTarget, t)
+}
+
+/* jsonlSink appends every session's packets, as JSON Lines, to a single
+shared file, so a log shipper (syslog, Filebeat, etc.) can tail it into a
+log pipeline. */
+type jsonlSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+/* newJSONLSink builds a jsonlSink from a jsonl -sink spec's options:
+path (default logDir/sessions.jsonl). */
+func newJSONLSink(opts map[string]string, logDir *string) (SessionSink, error) {
+	p := opts["path"]
+	if p == "" {
+		dir := "."
+		if logDir != nil {
+			dir = *logDir
+		}
+		p = path.Join(dir, "sessions.jsonl")
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return nil, fmt.Errorf("creating directory for %v: %w", p, err)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening %v: %w", p, err)
+	}
+	return &jsonlSink{f: f}, nil
+}
+
+/* jsonlRecord is one line of a jsonlSink's output file. */
+type jsonlRecord struct {
+	SessionID string    `json:"session_id"`
+	Time      time.Time `json:"time"`
+	ToTarget  bool      `json:"to_target"`
+	Length    int       `json:"length"`
+	Data      []byte    `json:"data"` /* base64-encoded by encoding/json */
+}
+
+/* Open implements SessionSink. */
+func (js *jsonlSink) Open(meta SessionMeta) (SessionLogger, error) {
+	return &jsonlLogger{sink: js, id: meta.ID}, nil
+}
+
+/* jsonlLogger is the SessionLogger returned by jsonlSink.Open. */
+type jsonlLogger struct {
+	sink *jsonlSink
+	id   string
+}
+
+/* LogPacket implements SessionLogger. */
+func (jl *jsonlLogger) LogPacket(p packet, toTarget bool, t time.Time) {
+	b, err := json.Marshal(jsonlRecord{
+		SessionID: jl.id,
+		Time:      t,
+		ToTarget:  toTarget,
+		Length:    p.length,
+		Data:      p.data[:p.length],
+	})
+	if err != nil {
+		log.Printf("Unable to marshal a packet of session %v: %v", jl.id, err)
+		return
+	}
+	b = append(b, '\n')
+	jl.sink.mu.Lock()
+	defer jl.sink.mu.Unlock()
+	if _, err := jl.sink.f.Write(b); err != nil {
+		log.Printf("Unable to write to %v: %v", jl.sink.f.Name(), err)
+	}
+}
+
+/* Close implements SessionLogger.  jsonlSink's file is shared by every
+session, so there's nothing session-specific to release. */
+func (jl *jsonlLogger) Close() {}
+
+/* httpSink streams each completed session's .owm-formatted bytes to url
+via an HTTP POST once it ends, for shipping sessions to an S3-compatible
+object store (via a presigned PUT-as-POST URL) or any other HTTP-POST-
+accepting store. */
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+/* newHTTPSink builds an httpSink from an http/s3 -sink spec's options:
+url (required). */
+func newHTTPSink(opts map[string]string) (SessionSink, error) {
+	u := opts["url"]
+	if u == "" {
+		return nil, fmt.Errorf("url= is required")
+	}
+	return &httpSink{url: u, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+/* Open implements SessionSink. */
+func (hs *httpSink) Open(meta SessionMeta) (SessionLogger, error) {
+	return &httpLogger{sink: hs, id: meta.ID}, nil
+}
+
+/* httpLogger buffers one session's packets in memory, in .owm format, and
+POSTs them to its sink's url on Close. */
+type httpLogger struct {
+	sink *httpSink
+	id   string
+	mu   sync.Mutex
+	buf  bytes.Buffer
+}
+
+/* LogPacket implements SessionLogger. */
+func (hl *httpLogger) LogPacket(p packet, toTarget bool, t time.Time) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	hl.buf.Write(owmRecord(p, toTarget, t))
+}
+
+/* Close implements SessionLogger: it POSTs the buffered session, if any
+bytes were logged, to hl.sink.url, tagging it with its session ID via the
+X-Session-Id header. */
+func (hl *httpLogger) Close() {
+	hl.mu.Lock()
+	data := hl.buf.Bytes()
+	hl.mu.Unlock()
+	if len(data) == 0 {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, hl.sink.url, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Unable to build an upload request for session %v: %v",
+			hl.id, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Session-Id", hl.id)
+	resp, err := hl.sink.client.Do(req)
+	if err != nil {
+		log.Printf("Unable to upload session %v to %v: %v",
+			hl.id, hl.sink.url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Uploading session %v to %v: unexpected status %v",
+			hl.id, hl.sink.url, resp.Status)
+	}
+}
+
+/* teeSink composes multiple SessionSinks, opening a session on each of
+them and fanning out every LogPacket/Close call to all that succeeded. */
+type teeSink []SessionSink
+
+/* Open implements SessionSink. */
+func (ts teeSink) Open(meta SessionMeta) (SessionLogger, error) {
+	loggers := make([]SessionLogger, 0, len(ts))
+	for _, s := range ts {
+		l, err := s.Open(meta)
+		if err != nil {
+			log.Printf("Unable to open a sink for session %v: %v",
+				meta.ID, err)
+			continue
+		}
+		if l != nil {
+			loggers = append(loggers, l)
+		}
+	}
+	if len(loggers) == 0 {
+		return nil, nil
+	}
+	return teeLogger(loggers), nil
+}
+
+/* teeLogger fans out to the SessionLoggers opened for one session by a
+teeSink. */
+type teeLogger []SessionLogger
+
+/* LogPacket implements SessionLogger. */
+func (tl teeLogger) LogPacket(p packet, toTarget bool, t time.Time) {
+	for _, l := range tl {
+		l.LogPacket(p, toTarget, t)
+	}
+}
+
+/* Close implements SessionLogger. */
+func (tl teeLogger) Close() {
+	for _, l := range tl {
+		l.Close()
+	}
+}
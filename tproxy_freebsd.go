@@ -0,0 +1,79 @@
+//go:build freebsd
+
+package main
+
+/*
+ * tproxy_freebsd.go
+ * FreeBSD SO_BINDANY transparent listening/dialing
+ * by J. Stuart McMurray
+ * created 20140516
+ * last modified 20140516
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+/* tproxyListener makes a TCPListener like listener, but sets SO_BINDANY
+on the listening socket so it can accept connections redirected (e.g. via
+pf's rdr-to/divert-to) to addresses it's not itself bound to. */
+func tproxyListener(t, addr string) (*net.TCPListener, error) {
+	lc := net.ListenConfig{Control: setBindAny}
+	l, err := lc.Listen(context.Background(), t, addr)
+	if err != nil {
+		return nil, err
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("%v did not yield a TCP listener", addr)
+	}
+	return tl, nil
+}
+
+/* tproxyDial makes an outbound TCP connection to target which appears, to
+target, to originate from original, using SO_BINDANY so the kernel allows
+binding to an address this host doesn't own. */
+func tproxyDial(original, target *net.TCPAddr) (*net.TCPConn, error) {
+	d := net.Dialer{LocalAddr: original, Control: setBindAny}
+	conn, err := d.Dial("tcp", target.String())
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%v is not a TCP connection", conn.RemoteAddr())
+	}
+	return tc, nil
+}
+
+/* setBindAny sets SO_BINDANY on the raw socket underlying c, letting it
+bind to, listen on, or dial from addresses it doesn't own, the way
+IP_TRANSPARENT does on Linux. */
+func setBindAny(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_BINDANY, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+/* originalDst recovers the pre-redirect destination address of conn,
+which must have been accepted on a listener made by tproxyListener
+behind a pf rdr-to/divert-to rule.  Unlike Linux's iptables TPROXY, pf
+with SO_BINDANY doesn't hide the true destination behind a separate
+getsockopt -- the accepted socket's local address already is it. */
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	lad, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a TCP address", conn.LocalAddr())
+	}
+	return lad, nil
+}
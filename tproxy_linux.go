@@ -0,0 +1,167 @@
+//go:build linux
+
+package main
+
+/*
+ * tproxy_linux.go
+ * Linux IP_TRANSPARENT listening/dialing and SO_ORIGINAL_DST lookup
+ * by J. Stuart McMurray
+ * created 20140516
+ * last modified 20140516
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/* soOriginalDst and ip6tOriginalDst are the getsockopt optnames used to
+recover a TPROXY'd connection's pre-NAT destination.  They're not in the
+syscall package, as they're iptables-specific rather than generic
+sockopts. */
+const (
+	soOriginalDst   = 80
+	ip6tOriginalDst = 80
+)
+
+/* ipv6Transparent is IPV6_TRANSPARENT, the IPv6 analogue of
+syscall.IP_TRANSPARENT.  It's not in the syscall package. */
+const ipv6Transparent = 0x4b
+
+/* tproxyListener makes a TCPListener like listener, but sets
+IP_TRANSPARENT on the listening socket so it can accept connections
+TPROXY'd to addresses it's not itself bound to. */
+func tproxyListener(t, addr string) (*net.TCPListener, error) {
+	lc := net.ListenConfig{Control: setTransparent}
+	l, err := lc.Listen(context.Background(), t, addr)
+	if err != nil {
+		return nil, err
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("%v did not yield a TCP listener", addr)
+	}
+	return tl, nil
+}
+
+/* tproxyDial makes an outbound TCP connection to target which appears, to
+target, to originate from original, using IP_TRANSPARENT so the kernel
+allows binding to an address this host doesn't own. */
+func tproxyDial(original, target *net.TCPAddr) (*net.TCPConn, error) {
+	d := net.Dialer{LocalAddr: original, Control: setTransparent}
+	conn, err := d.Dial("tcp", target.String())
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%v is not a TCP connection", conn.RemoteAddr())
+	}
+	return tc, nil
+}
+
+/* setTransparent sets IP_TRANSPARENT (or, for an IPv6 socket,
+IPV6_TRANSPARENT) on the raw socket underlying c, letting it bind to,
+listen on, or dial from addresses it doesn't own, as TPROXY requires. */
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6,
+				ipv6Transparent, 1)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP,
+				syscall.IP_TRANSPARENT, 1)
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+/* originalDst recovers the pre-NAT destination address of conn, which must
+have been accepted on a listener made by tproxyListener behind an
+iptables TPROXY rule, via getsockopt(SO_ORIGINAL_DST). */
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	sc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("getting raw conn: %w", err)
+	}
+
+	rad, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a TCP address", conn.RemoteAddr())
+	}
+
+	var addr *net.TCPAddr
+	var operr error
+	if err := sc.Control(func(fd uintptr) {
+		if nil != rad.IP.To4() {
+			addr, operr = getOriginalDst4(int(fd))
+		} else {
+			addr, operr = getOriginalDst6(int(fd))
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("controlling raw conn: %w", err)
+	}
+	return addr, operr
+}
+
+/* sockaddrIn mirrors struct sockaddr_in, as filled in by
+getsockopt(SO_ORIGINAL_DST). */
+type sockaddrIn struct {
+	family uint16
+	port   uint16
+	addr   [4]byte
+	zero   [8]byte
+}
+
+/* getOriginalDst4 recovers an IPv4 pre-NAT destination from fd via
+getsockopt(SOL_IP, SO_ORIGINAL_DST). */
+func getOriginalDst4(fd int) (*net.TCPAddr, error) {
+	var sa sockaddrIn
+	size := uint32(unsafe.Sizeof(sa))
+	if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT,
+		uintptr(fd), uintptr(syscall.SOL_IP), uintptr(soOriginalDst),
+		uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)),
+		0); 0 != errno {
+		return nil, errno
+	}
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa.addr[0], sa.addr[1], sa.addr[2], sa.addr[3]),
+		Port: int(sa.port>>8 | sa.port<<8),
+	}, nil
+}
+
+/* sockaddrIn6 mirrors struct sockaddr_in6, as filled in by
+getsockopt(IP6T_SO_ORIGINAL_DST). */
+type sockaddrIn6 struct {
+	family   uint16
+	port     uint16
+	flowinfo uint32
+	addr     [16]byte
+	scopeID  uint32
+}
+
+/* getOriginalDst6 recovers an IPv6 pre-NAT destination from fd via
+getsockopt(SOL_IPV6, IP6T_SO_ORIGINAL_DST). */
+func getOriginalDst6(fd int) (*net.TCPAddr, error) {
+	var sa sockaddrIn6
+	size := uint32(unsafe.Sizeof(sa))
+	if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT,
+		uintptr(fd), uintptr(syscall.SOL_IPV6), uintptr(ip6tOriginalDst),
+		uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)),
+		0); 0 != errno {
+		return nil, errno
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(sa.addr[:]),
+		Port: int(sa.port>>8 | sa.port<<8),
+	}, nil
+}
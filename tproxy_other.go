@@ -0,0 +1,32 @@
+//go:build !linux && !freebsd
+
+package main
+
+/*
+ * tproxy_other.go
+ * Stub -tproxy support for platforms without a transparent-proxy path
+ * by J. Stuart McMurray
+ * created 20140516
+ * last modified 20140516
+ */
+
+import (
+	"fmt"
+	"net"
+)
+
+/* tproxyListener, tproxyDial, and originalDst are only implemented on
+Linux (IP_TRANSPARENT/SO_ORIGINAL_DST) and FreeBSD (SO_BINDANY).  On
+other platforms -tproxy simply fails with a clear error. */
+
+func tproxyListener(t, addr string) (*net.TCPListener, error) {
+	return nil, fmt.Errorf("-tproxy is only supported on Linux and FreeBSD")
+}
+
+func tproxyDial(original, target *net.TCPAddr) (*net.TCPConn, error) {
+	return nil, fmt.Errorf("-tproxy is only supported on Linux and FreeBSD")
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("-tproxy is only supported on Linux and FreeBSD")
+}